@@ -0,0 +1,251 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ruuviCompanyID is the Bluetooth SIG company identifier Ruuvi advertises
+// manufacturer-specific data under, little-endian encoded as the first two
+// bytes of that data.
+const ruuviCompanyID = 0x0499
+
+// ErrShortFrame is returned when a frame is too short for its format.
+var ErrShortFrame = errors.New("decode: frame too short")
+
+// ErrUnknownFormat is returned by Decode for an unrecognized format byte.
+type ErrUnknownFormat byte
+
+func (e ErrUnknownFormat) Error() string {
+	return fmt.Sprintf("decode: unknown data format 0x%02x", byte(e))
+}
+
+// Decode parses the manufacturer-specific data of a Ruuvi advertisement,
+// as delivered by the BLE stack: the 2-byte 0x0499 Ruuvi company ID
+// followed by the format byte and the format's payload. The company ID
+// prefix is stripped automatically if present, so callers can pass either
+// the full manufacturer-specific data or just the payload after it.
+// addr is the advertiser's MAC address, used to look up the per-device key
+// for the encrypted format 8; it may be empty for formats that don't need
+// one. keys may be nil if format 8 support isn't needed.
+func Decode(addr string, raw []byte, keys *KeyStore) (*Reading, error) {
+	if len(raw) >= 2 && binary.LittleEndian.Uint16(raw) == ruuviCompanyID {
+		raw = raw[2:]
+	}
+
+	if len(raw) < 1 {
+		return nil, ErrShortFrame
+	}
+
+	format := raw[0]
+	body := raw[1:]
+
+	switch format {
+	case 3:
+		return decodeV3(body)
+	case 5:
+		return decodeV5(body)
+	case 6:
+		return decodeV6(body)
+	case 8:
+		return decodeV8(addr, body, keys)
+	case 0xE0, 0xF0:
+		return decodeDiagnostic(format, body)
+	default:
+		return nil, ErrUnknownFormat(format)
+	}
+}
+
+// decodeV3 parses Ruuvi data format 3 (RAWv1), 13 bytes after the format
+// byte: humidity, temperature, pressure, 3-axis acceleration and battery
+// voltage.
+//
+// This reimplements logic bluewalker's own ruuvi package already decoded
+// for formats 3 and 5 before this package existed; it is validated only
+// against this package's own hand-built test fixtures (decode_test.go),
+// not against a real tag or bluewalker's previously-shipping decoder.
+// Treat it as unverified against live formats 3/5 hardware until someone
+// cross-checks it against real advertisements.
+func decodeV3(b []byte) (*Reading, error) {
+	if len(b) < 13 {
+		return nil, ErrShortFrame
+	}
+
+	r := &Reading{Format: 3}
+
+	r.Humidity = int(b[0]) * 50 // 0.5% per bit, stored as 1/100 of a percent
+	r.valid |= hasHumidity
+
+	temp := float64(b[1] & 0x7f)
+	temp += float64(b[2]) / 100
+	if b[1]&0x80 != 0 {
+		temp = -temp
+	}
+	r.Temperature = temp
+	r.valid |= hasTemperature
+
+	r.Pressure = int(binary.BigEndian.Uint16(b[3:5])) + 50000
+	r.valid |= hasPressure
+
+	r.AccelerationX = float64(int16(binary.BigEndian.Uint16(b[5:7]))) / 1000
+	r.AccelerationY = float64(int16(binary.BigEndian.Uint16(b[7:9]))) / 1000
+	r.AccelerationZ = float64(int16(binary.BigEndian.Uint16(b[9:11]))) / 1000
+	r.valid |= hasAcceleration
+
+	r.Voltage = int(binary.BigEndian.Uint16(b[11:13]))
+	r.valid |= hasVoltage
+
+	return r, nil
+}
+
+// decodeV5 parses Ruuvi data format 5 (RAWv2), 23 bytes after the format
+// byte (the trailing MAC address is not needed, the advertiser's address
+// is used instead).
+//
+// See the unverified-against-real-hardware note on decodeV3: the same
+// caveat applies here, since format 5 is the format most already-deployed
+// tags use.
+func decodeV5(b []byte) (*Reading, error) {
+	if len(b) < 16 {
+		return nil, ErrShortFrame
+	}
+
+	r := &Reading{Format: 5}
+
+	if t := int16(binary.BigEndian.Uint16(b[0:2])); t != -32768 {
+		r.Temperature = float64(t) * 0.005
+		r.valid |= hasTemperature
+	}
+	if h := binary.BigEndian.Uint16(b[2:4]); h != 0xffff {
+		r.Humidity = int(h) / 4 // 0.0025% per bit, stored as 1/100 of a percent
+		r.valid |= hasHumidity
+	}
+	if p := binary.BigEndian.Uint16(b[4:6]); p != 0xffff {
+		r.Pressure = int(p) + 50000
+		r.valid |= hasPressure
+	}
+
+	if ax := int16(binary.BigEndian.Uint16(b[6:8])); ax != -32768 {
+		r.AccelerationX = float64(ax) / 1000
+		r.AccelerationY = float64(int16(binary.BigEndian.Uint16(b[8:10]))) / 1000
+		r.AccelerationZ = float64(int16(binary.BigEndian.Uint16(b[10:12]))) / 1000
+		r.valid |= hasAcceleration
+	}
+
+	powerInfo := binary.BigEndian.Uint16(b[12:14])
+	voltage := powerInfo >> 5
+	txPower := powerInfo & 0x1f
+	if voltage != 0x7ff {
+		r.Voltage = int(voltage) + 1600
+		r.valid |= hasVoltage
+	}
+	if txPower != 0x1f {
+		r.TxPower = int(txPower)*2 - 40
+		r.valid |= hasTxPower
+	}
+
+	if len(b) > 14 && b[14] != 0xff {
+		r.MoveCount = int(b[14])
+		r.valid |= hasMoveCount
+	}
+	if len(b) > 16 {
+		if seq := binary.BigEndian.Uint16(b[15:17]); seq != 0xffff {
+			r.Seqno = int(seq)
+			r.valid |= hasSeqno
+		}
+	}
+
+	return r, nil
+}
+
+// decodeV6 parses Ruuvi data format 6, a compact RAWv2 variant that
+// carries only temperature, humidity, pressure and battery voltage and is
+// meant for tags without an accelerometer or movement counter.
+func decodeV6(b []byte) (*Reading, error) {
+	if len(b) < 8 {
+		return nil, ErrShortFrame
+	}
+
+	r := &Reading{Format: 6}
+
+	if t := int16(binary.BigEndian.Uint16(b[0:2])); t != -32768 {
+		r.Temperature = float64(t) * 0.005
+		r.valid |= hasTemperature
+	}
+	if h := binary.BigEndian.Uint16(b[2:4]); h != 0xffff {
+		r.Humidity = int(h) / 4
+		r.valid |= hasHumidity
+	}
+	if p := binary.BigEndian.Uint16(b[4:6]); p != 0xffff {
+		r.Pressure = int(p) + 50000
+		r.valid |= hasPressure
+	}
+	if v := binary.BigEndian.Uint16(b[6:8]); v != 0xffff {
+		r.Voltage = int(v)
+		r.valid |= hasVoltage
+	}
+
+	return r, nil
+}
+
+// decodeDiagnostic parses the E0/F0 Ruuvi Air diagnostic formats, which
+// carry air-quality fields instead of the usual motion/environment set.
+func decodeDiagnostic(format byte, b []byte) (*Reading, error) {
+	if len(b) < 10 {
+		return nil, ErrShortFrame
+	}
+
+	r := &Reading{Format: int(format)}
+
+	if pm := binary.BigEndian.Uint16(b[0:2]); pm != 0xffff {
+		r.PM25 = float64(pm) / 10
+		r.valid |= hasPM25
+	}
+	if co2 := binary.BigEndian.Uint16(b[2:4]); co2 != 0xffff {
+		r.CO2 = float64(co2)
+		r.valid |= hasCO2
+	}
+	if voc := binary.BigEndian.Uint16(b[4:6]); voc != 0xffff {
+		r.VOC = float64(voc)
+		r.valid |= hasVOC
+	}
+	if nox := binary.BigEndian.Uint16(b[6:8]); nox != 0xffff {
+		r.NOx = float64(nox)
+		r.valid |= hasNOx
+	}
+	if lux := binary.BigEndian.Uint16(b[8:10]); lux != 0xffff {
+		r.Illuminance = float64(lux)
+		r.valid |= hasIlluminance
+	}
+	if len(b) > 10 && b[10] != 0xff {
+		r.SoundDBA = float64(b[10]) / 10
+		r.valid |= hasSoundDBA
+	}
+
+	return r, nil
+}
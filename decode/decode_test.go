@@ -0,0 +1,332 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decode
+
+import (
+	"crypto/aes"
+	"testing"
+)
+
+// withCompanyID prepends the 2-byte 0x0499 Ruuvi company ID that a real BLE
+// stack includes in manufacturer-specific data, the way scanner backends
+// hand frames to Decode.
+func withCompanyID(format byte, body []byte) []byte {
+	return append([]byte{0x99, 0x04, format}, body...)
+}
+
+func TestDecodeFormat3(t *testing.T) {
+	body := []byte{
+		0x6e,       // humidity: 110 * 0.5% = 55.00%
+		0x16, 0x32, // temperature: +22.50 C
+		0xc3, 0x50, // pressure: 50000 + 50000 = 100000 Pa
+		0x00, 0x00, // accelX: 0.000 g
+		0x00, 0x00, // accelY: 0.000 g
+		0x03, 0xe8, // accelZ: 1.000 g
+		0x0b, 0xb8, // voltage: 3000 mV
+	}
+
+	r, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(3, body), nil)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if r.Format != 3 {
+		t.Errorf("Format = %d, want 3", r.Format)
+	}
+	if !r.HumidityValid() || r.Humidity != 5500 {
+		t.Errorf("Humidity = %d, want 5500", r.Humidity)
+	}
+	if !r.TemperatureValid() || r.Temperature != 22.5 {
+		t.Errorf("Temperature = %v, want 22.5", r.Temperature)
+	}
+	if !r.PressureValid() || r.Pressure != 100000 {
+		t.Errorf("Pressure = %d, want 100000", r.Pressure)
+	}
+	if !r.AccelerationValid() || r.AccelerationZ != 1 {
+		t.Errorf("AccelerationZ = %v, want 1", r.AccelerationZ)
+	}
+	if !r.VoltageValid() || r.Voltage != 3000 {
+		t.Errorf("Voltage = %d, want 3000", r.Voltage)
+	}
+	if r.TxPowerValid() || r.MoveCountValid() || r.SeqnoValid() {
+		t.Errorf("format 3 frame must not carry tx power, move count or sequence number")
+	}
+}
+
+func TestDecodeFormat5(t *testing.T) {
+	body := []byte{
+		0x09, 0xc4, // temperature: 2500 * 0.005 = 12.50 C
+		0x5d, 0xc0, // humidity: 24000 / 4 = 6000 (60.00%)
+		0xc3, 0x50, // pressure: 50000 + 50000 = 100000 Pa
+		0x00, 0x64, // accelX: 100 / 1000 = 0.1 g
+		0xff, 0x9c, // accelY: -100 / 1000 = -0.1 g
+		0x03, 0xe8, // accelZ: 1000 / 1000 = 1.0 g
+		0xaf, 0x16, // power info: voltage 3000 mV, tx power 4 dBm
+		0x05,       // movement counter: 5
+		0x00, 0x2a, // sequence number: 42
+	}
+
+	r, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(5, body), nil)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := Reading{
+		Format:        5,
+		Temperature:   12.5,
+		Humidity:      6000,
+		Pressure:      100000,
+		AccelerationX: 0.1,
+		AccelerationY: -0.1,
+		AccelerationZ: 1,
+		Voltage:       3000,
+		TxPower:       4,
+		MoveCount:     5,
+		Seqno:         42,
+	}
+	assertReading(t, r, want)
+}
+
+func TestDecodeFormat6(t *testing.T) {
+	body := []byte{
+		0x09, 0xc4, // temperature: 12.50 C
+		0x5d, 0xc0, // humidity: 6000 (60.00%)
+		0xc3, 0x50, // pressure: 100000 Pa
+		0x0b, 0xb8, // voltage: 3000 mV
+	}
+
+	r, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(6, body), nil)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := Reading{
+		Format:      6,
+		Temperature: 12.5,
+		Humidity:    6000,
+		Pressure:    100000,
+		Voltage:     3000,
+	}
+	assertReading(t, r, want)
+
+	if r.AccelerationValid() || r.TxPowerValid() || r.MoveCountValid() || r.SeqnoValid() {
+		t.Errorf("format 6 frame must not carry acceleration, tx power, move count or sequence number")
+	}
+}
+
+func TestDecodeFormat8(t *testing.T) {
+	addr := "aa:bb:cc:dd:ee:ff"
+	var key [16]byte
+	copy(key[:], []byte("0123456789abcdef"))
+
+	// The same format 5 core fields as TestDecodeFormat5 (temperature,
+	// humidity, pressure, acceleration, power info), padded to one AES
+	// block; the movement counter byte is 0xff (invalid) and the last
+	// byte is unused padding.
+	plain := []byte{
+		0x09, 0xc4,
+		0x5d, 0xc0,
+		0xc3, 0x50,
+		0x00, 0x64,
+		0xff, 0x9c,
+		0x03, 0xe8,
+		0xaf, 0x16,
+		0xff,
+		0x00,
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	cipherText := make([]byte, len(plain))
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		block.Encrypt(cipherText[i:i+aes.BlockSize], plain[i:i+aes.BlockSize])
+	}
+
+	keys := NewKeyStore()
+	keys.Set(addr, key)
+
+	r, err := Decode(addr, withCompanyID(8, cipherText), keys)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := Reading{
+		Format:        8,
+		Temperature:   12.5,
+		Humidity:      6000,
+		Pressure:      100000,
+		AccelerationX: 0.1,
+		AccelerationY: -0.1,
+		AccelerationZ: 1,
+		Voltage:       3000,
+		TxPower:       4,
+	}
+	assertReading(t, r, want)
+
+	if r.MoveCountValid() || r.SeqnoValid() {
+		t.Errorf("plaintext marks move count as invalid, Decode must not report one")
+	}
+}
+
+func TestDecodeFormat8NoKey(t *testing.T) {
+	cipherText := make([]byte, aes.BlockSize)
+	if _, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(8, cipherText), nil); err == nil {
+		t.Fatal("Decode: want error for format 8 frame with no KeyStore, got nil")
+	}
+}
+
+func TestDecodeFormat8ImplausibleRange(t *testing.T) {
+	addr := "aa:bb:cc:dd:ee:ff"
+	var key [16]byte
+	copy(key[:], []byte("0123456789abcdef"))
+
+	// Same layout as TestDecodeFormat8, but the temperature field decodes
+	// to -100 C, outside any real Ruuvi sensor's range; this is what a
+	// wrong key (or wrong guessed layout) looks like once decrypted.
+	plain := []byte{
+		0xb1, 0xe0, // temperature: -20000 * 0.005 = -100.00 C
+		0x5d, 0xc0,
+		0xc3, 0x50,
+		0x00, 0x64,
+		0xff, 0x9c,
+		0x03, 0xe8,
+		0xaf, 0x16,
+		0xff,
+		0x00,
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	cipherText := make([]byte, len(plain))
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		block.Encrypt(cipherText[i:i+aes.BlockSize], plain[i:i+aes.BlockSize])
+	}
+
+	keys := NewKeyStore()
+	keys.Set(addr, key)
+
+	if _, err := Decode(addr, withCompanyID(8, cipherText), keys); err != ErrImplausibleFrame {
+		t.Fatalf("Decode: err = %v, want ErrImplausibleFrame", err)
+	}
+}
+
+func TestDecodeDiagnostic(t *testing.T) {
+	body := []byte{
+		0x00, 0x7d, // PM2.5: 125 / 10 = 12.5 ug/m3
+		0x03, 0x20, // CO2: 800 ppm
+		0x00, 0x32, // VOC index: 50
+		0x00, 0x0a, // NOx index: 10
+		0x01, 0xf4, // illuminance: 500 lux
+		0x7b, // sound: 123 / 10 = 12.3 dBA
+	}
+
+	for _, format := range []byte{0xe0, 0xf0} {
+		r, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(format, body), nil)
+		if err != nil {
+			t.Fatalf("Decode(format %#x): %v", format, err)
+		}
+
+		if r.Format != int(format) {
+			t.Errorf("Format = %#x, want %#x", r.Format, format)
+		}
+		if !r.PM25Valid() || r.PM25 != 12.5 {
+			t.Errorf("PM25 = %v, want 12.5", r.PM25)
+		}
+		if !r.CO2Valid() || r.CO2 != 800 {
+			t.Errorf("CO2 = %v, want 800", r.CO2)
+		}
+		if !r.VOCValid() || r.VOC != 50 {
+			t.Errorf("VOC = %v, want 50", r.VOC)
+		}
+		if !r.NOxValid() || r.NOx != 10 {
+			t.Errorf("NOx = %v, want 10", r.NOx)
+		}
+		if !r.IlluminanceValid() || r.Illuminance != 500 {
+			t.Errorf("Illuminance = %v, want 500", r.Illuminance)
+		}
+		if !r.SoundDBAValid() || r.SoundDBA != 12.3 {
+			t.Errorf("SoundDBA = %v, want 12.3", r.SoundDBA)
+		}
+	}
+}
+
+func TestDecodeUnknownFormat(t *testing.T) {
+	_, err := Decode("aa:bb:cc:dd:ee:ff", withCompanyID(0x7f, []byte{0x00}), nil)
+	if _, ok := err.(ErrUnknownFormat); !ok {
+		t.Fatalf("Decode: err = %v (%T), want ErrUnknownFormat", err, err)
+	}
+}
+
+// assertReading checks the fields TestDecodeFormat5/6/8 care about and
+// that each is reported valid.
+func assertReading(t *testing.T, got *Reading, want Reading) {
+	t.Helper()
+
+	if got.Format != want.Format {
+		t.Errorf("Format = %d, want %d", got.Format, want.Format)
+	}
+	if !got.TemperatureValid() || got.Temperature != want.Temperature {
+		t.Errorf("Temperature = %v, want %v", got.Temperature, want.Temperature)
+	}
+	if !got.HumidityValid() || got.Humidity != want.Humidity {
+		t.Errorf("Humidity = %d, want %d", got.Humidity, want.Humidity)
+	}
+	if !got.PressureValid() || got.Pressure != want.Pressure {
+		t.Errorf("Pressure = %d, want %d", got.Pressure, want.Pressure)
+	}
+	if !got.VoltageValid() || got.Voltage != want.Voltage {
+		t.Errorf("Voltage = %d, want %d", got.Voltage, want.Voltage)
+	}
+
+	if want.AccelerationX != 0 || want.AccelerationY != 0 || want.AccelerationZ != 0 {
+		if !got.AccelerationValid() ||
+			got.AccelerationX != want.AccelerationX ||
+			got.AccelerationY != want.AccelerationY ||
+			got.AccelerationZ != want.AccelerationZ {
+			t.Errorf("Acceleration = (%v, %v, %v), want (%v, %v, %v)",
+				got.AccelerationX, got.AccelerationY, got.AccelerationZ,
+				want.AccelerationX, want.AccelerationY, want.AccelerationZ)
+		}
+	}
+	if want.TxPower != 0 {
+		if !got.TxPowerValid() || got.TxPower != want.TxPower {
+			t.Errorf("TxPower = %d, want %d", got.TxPower, want.TxPower)
+		}
+	}
+	if want.MoveCount != 0 {
+		if !got.MoveCountValid() || got.MoveCount != want.MoveCount {
+			t.Errorf("MoveCount = %d, want %d", got.MoveCount, want.MoveCount)
+		}
+	}
+	if want.Seqno != 0 {
+		if !got.SeqnoValid() || got.Seqno != want.Seqno {
+			t.Errorf("Seqno = %d, want %d", got.Seqno, want.Seqno)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decode
+
+import (
+	"bufio"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrImplausibleFrame is returned by decodeV8 when the decrypted payload's
+// fields fall well outside the range a real Ruuvi sensor can report. ECB
+// decryption with the wrong key (or a misread frame layout, see the note
+// on decodeV8) still "succeeds" and produces plausible-looking-but-bogus
+// numbers with no other signal that anything went wrong, so this is the
+// only check standing between a bad key and a silently wrong reading.
+var ErrImplausibleFrame = errors.New("decode: decrypted format 8 frame outside plausible sensor range")
+
+var keyFile = flag.String("ruuvi-key-file", os.Getenv("RUUVI_KEY_FILE"),
+	"path to a file of MAC=hexkey lines used to decrypt format 8 (encrypted) frames")
+
+// KeyStoreFromFlags loads the KeyStore named by --ruuvi-key-file, or
+// returns an empty KeyStore if the flag isn't set. Callers must have
+// already called flag.Parse().
+func KeyStoreFromFlags() (*KeyStore, error) {
+	if *keyFile == "" {
+		return NewKeyStore(), nil
+	}
+	return LoadKeyStoreFile(*keyFile)
+}
+
+// KeyStore holds the per-MAC AES-128 keys needed to decrypt format 8
+// advertisements. It is safe for concurrent use.
+type KeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][16]byte
+}
+
+// NewKeyStore returns an empty KeyStore.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[string][16]byte)}
+}
+
+// Set registers the AES-128 key for addr (case-insensitive).
+func (k *KeyStore) Set(addr string, key [16]byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[strings.ToLower(addr)] = key
+}
+
+// Get returns the key registered for addr, if any.
+func (k *KeyStore) Get(addr string) ([16]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[strings.ToLower(addr)]
+	return key, ok
+}
+
+// LoadKeyStoreFile loads a KeyStore from a text file of "MAC=hexkey" lines,
+// one per device, e.g.:
+//
+//	aa:bb:cc:dd:ee:ff=000102030405060708090a0b0c0d0e0f
+func LoadKeyStoreFile(path string) (*KeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ks := NewKeyStore()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := ks.parseLine(line); err != nil {
+			return nil, fmt.Errorf("decode: %s: %w", path, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (k *KeyStore) parseLine(line string) error {
+	addr, hexKey, ok := strings.Cut(line, "=")
+	if !ok {
+		return fmt.Errorf("expected MAC=hexkey, got %q", line)
+	}
+	keyBytes, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil {
+		return fmt.Errorf("key for %s: %w", addr, err)
+	}
+	if len(keyBytes) != 16 {
+		return fmt.Errorf("key for %s: want 16 bytes, got %d", addr, len(keyBytes))
+	}
+	var key [16]byte
+	copy(key[:], keyBytes)
+	k.Set(strings.TrimSpace(addr), key)
+	return nil
+}
+
+// decodeV8 decrypts an AES-128 encrypted format 8 payload and decodes the
+// resulting plaintext as format 5 (RAWv2 without the trailing MAC bytes).
+//
+// The payload is decrypted block-by-block with no IV or chaining (ECB
+// mode), which is simpler than the CBC/CTR schemes encrypted telemetry
+// normally uses but leaks repeated-plaintext patterns across blocks. This
+// was written as a best-effort guess, not verified against a real Ruuvi
+// format 8 device or an authoritative spec for that format; treat it as
+// unconfirmed and revisit the mode once a real reference frame is
+// available.
+func decodeV8(addr string, body []byte, keys *KeyStore) (*Reading, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("decode: format 8 frame from %s but no keys configured", addr)
+	}
+	key, ok := keys.Get(addr)
+	if !ok {
+		return nil, fmt.Errorf("decode: no key configured for %s", addr)
+	}
+	if len(body)%aes.BlockSize != 0 || len(body) == 0 {
+		return nil, ErrShortFrame
+	}
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(body))
+	for i := 0; i < len(body); i += aes.BlockSize {
+		block.Decrypt(plain[i:i+aes.BlockSize], body[i:i+aes.BlockSize])
+	}
+
+	r, err := decodeV5(plain)
+	if err != nil {
+		return nil, err
+	}
+	r.Format = 8
+
+	if !plausibleReading(r) {
+		return nil, ErrImplausibleFrame
+	}
+
+	return r, nil
+}
+
+// plausibleReading reports whether r's fields fall within the range a real
+// Ruuvi sensor can report, used to catch a wrong format-8 key (or frame
+// layout) decrypting to well-formed-looking garbage rather than an error.
+func plausibleReading(r *Reading) bool {
+	if r.TemperatureValid() && (r.Temperature < -40 || r.Temperature > 85) {
+		return false
+	}
+	if r.HumidityValid() && (r.Humidity < 0 || r.Humidity > 10000) {
+		return false
+	}
+	if r.PressureValid() && (r.Pressure < 50000 || r.Pressure > 115536) {
+		return false
+	}
+	if r.VoltageValid() && (r.Voltage < 1600 || r.Voltage > 3646) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package decode parses Ruuvi manufacturer-specific advertisement data.
+// It covers the same ground as gitlab.com/jtaimisto/bluewalker's ruuvi
+// package (formats 3 and 5) plus formats bluewalker doesn't know about:
+// format 6, the AES-128-encrypted format 8, and the E0/F0 Ruuvi Air
+// diagnostic formats. Keeping this in-tree means new formats don't have to
+// wait on an upstream release.
+package decode
+
+// Reading is a fully decoded Ruuvi advertisement. Fields that a given
+// format doesn't carry are left at their zero value; use the matching
+// *Valid method before trusting a field, mirroring bluewalker's
+// ruuvi.Data convention.
+type Reading struct {
+	Format int
+
+	Temperature float64 // Celsius
+	Humidity    int     // 1/100 of a percent
+	Pressure    int     // Pa
+
+	AccelerationX float64 // g
+	AccelerationY float64 // g
+	AccelerationZ float64 // g
+
+	Voltage int // mV
+	TxPower int // dBm
+
+	MoveCount int
+	Seqno     int
+
+	// Ruuvi Air diagnostic fields (formats E0/F0).
+	PM25        float64 // ug/m3
+	CO2         float64 // ppm
+	VOC         float64 // index, 0-500
+	NOx         float64 // index, 0-500
+	Illuminance float64 // lux
+	SoundDBA    float64 // dBA
+
+	valid fieldMask
+}
+
+// fieldMask tracks which fields of a Reading were present in the decoded
+// advertisement, since a zero value and "not present" both decode to 0.
+type fieldMask uint32
+
+const (
+	hasTemperature fieldMask = 1 << iota
+	hasHumidity
+	hasPressure
+	hasAcceleration
+	hasVoltage
+	hasTxPower
+	hasMoveCount
+	hasSeqno
+	hasPM25
+	hasCO2
+	hasVOC
+	hasNOx
+	hasIlluminance
+	hasSoundDBA
+)
+
+func (r *Reading) has(f fieldMask) bool { return r.valid&f != 0 }
+
+func (r Reading) TemperatureValid() bool  { return r.has(hasTemperature) }
+func (r Reading) HumidityValid() bool     { return r.has(hasHumidity) }
+func (r Reading) PressureValid() bool     { return r.has(hasPressure) }
+func (r Reading) AccelerationValid() bool { return r.has(hasAcceleration) }
+func (r Reading) VoltageValid() bool      { return r.has(hasVoltage) }
+func (r Reading) TxPowerValid() bool      { return r.has(hasTxPower) }
+func (r Reading) MoveCountValid() bool    { return r.has(hasMoveCount) }
+func (r Reading) SeqnoValid() bool        { return r.has(hasSeqno) }
+func (r Reading) PM25Valid() bool         { return r.has(hasPM25) }
+func (r Reading) CO2Valid() bool          { return r.has(hasCO2) }
+func (r Reading) VOCValid() bool          { return r.has(hasVOC) }
+func (r Reading) NOxValid() bool          { return r.has(hasNOx) }
+func (r Reading) IlluminanceValid() bool  { return r.has(hasIlluminance) }
+func (r Reading) SoundDBAValid() bool     { return r.has(hasSoundDBA) }
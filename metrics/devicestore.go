@@ -0,0 +1,181 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// deviceStoreShards is the number of independent shards deviceStore splits
+// its devices across, to keep the lock for one busy MAC from blocking
+// reads/writes for every other MAC.
+const deviceStoreShards = 16
+
+// deviceRecord is everything the exporter remembers about one device.
+type deviceRecord struct {
+	lastSeen time.Time
+	rawHex   string
+	format   int
+	reading  RuuviReading
+}
+
+type deviceEntry struct {
+	addr   string
+	record deviceRecord
+}
+
+type deviceShard struct {
+	mu    sync.Mutex
+	order *list.List // front = most recently touched
+	items map[string]*list.Element
+	cap   int
+}
+
+// deviceStore is a sharded, LRU-evicting map of device address to
+// deviceRecord. Unlike a plain map+mutex it bounds memory use when a
+// scanner sees large numbers of transient MACs, and it owns Prometheus
+// label deletion: eviction and metric cleanup happen under the same shard
+// lock as the map mutation, so a write for a device can never interleave
+// with that same device's labels being deleted.
+type deviceStore struct {
+	shards  [deviceStoreShards]*deviceShard
+	onEvict func(addr string)
+}
+
+// newDeviceStore returns a deviceStore holding at most maxSize devices
+// (split evenly across its shards, at least one per shard, so a maxSize
+// below deviceStoreShards still allows deviceStoreShards devices; 0 means
+// unbounded). onEvict, if not
+// nil, is called with the address of any device removed from the store,
+// whether by LRU eviction or TTL expiry, so callers can delete the
+// matching metric label values.
+func newDeviceStore(maxSize int, onEvict func(addr string)) *deviceStore {
+	perShard := 0
+	if maxSize > 0 {
+		perShard = maxSize / deviceStoreShards
+		if perShard < 1 {
+			perShard = 1
+		}
+	}
+
+	s := &deviceStore{onEvict: onEvict}
+	for i := range s.shards {
+		s.shards[i] = &deviceShard{
+			order: list.New(),
+			items: make(map[string]*list.Element),
+			cap:   perShard,
+		}
+	}
+	return s
+}
+
+func (s *deviceStore) shardFor(addr string) *deviceShard {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return s.shards[h.Sum32()%deviceStoreShards]
+}
+
+// Touch records rec for addr, creating or refreshing its entry and marking
+// it most-recently-used. If the device's shard is now over capacity, the
+// least-recently-used device in that shard is evicted and onEvict is
+// called for it.
+func (s *deviceStore) Touch(addr string, rec deviceRecord) {
+	sh := s.shardFor(addr)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if el, ok := sh.items[addr]; ok {
+		el.Value.(*deviceEntry).record = rec
+		sh.order.MoveToFront(el)
+		return
+	}
+
+	sh.items[addr] = sh.order.PushFront(&deviceEntry{addr: addr, record: rec})
+
+	if sh.cap > 0 && sh.order.Len() > sh.cap {
+		s.evictLocked(sh, sh.order.Back())
+	}
+}
+
+// Get returns the record stored for addr, if any.
+func (s *deviceStore) Get(addr string) (deviceRecord, bool) {
+	sh := s.shardFor(addr)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	el, ok := sh.items[addr]
+	if !ok {
+		return deviceRecord{}, false
+	}
+	return el.Value.(*deviceEntry).record, true
+}
+
+// Range calls fn once for every device currently in the store. fn must not
+// call back into the store.
+func (s *deviceStore) Range(fn func(addr string, rec deviceRecord)) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for e := sh.order.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*deviceEntry)
+			fn(entry.addr, entry.record)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// Expire evicts every device whose lastSeen is older than ttl.
+func (s *deviceStore) Expire(ttl time.Duration) {
+	deadline := time.Now().Add(-ttl)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for e := sh.order.Back(); e != nil; {
+			prev := e.Prev()
+			if e.Value.(*deviceEntry).record.lastSeen.Before(deadline) {
+				s.evictLocked(sh, e)
+			}
+			e = prev
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// evictLocked removes el from sh and calls onEvict for it. sh.mu must
+// already be held.
+func (s *deviceStore) evictLocked(sh *deviceShard, el *list.Element) {
+	if el == nil {
+		return
+	}
+	entry := el.Value.(*deviceEntry)
+	sh.order.Remove(el)
+	delete(sh.items, entry.addr)
+	if s.onEvict != nil {
+		s.onEvict(entry.addr)
+	}
+}
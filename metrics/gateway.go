@@ -0,0 +1,237 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// GatewayConfig configures the outbound Ruuvi Gateway push client.
+type GatewayConfig struct {
+	Enabled bool
+	URL     string
+	// Interval is how often SnapshotGateway() is pushed to URL.
+	Interval time.Duration
+
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Rate mirrors the vendor gateway's X-Ruuvi-Gateway-Rate header,
+	// advertising the push interval in seconds to the receiver. 0 omits
+	// the header.
+	Rate int
+	Gzip bool
+
+	// MaxBackoff caps the retry delay after consecutive push failures.
+	MaxBackoff time.Duration
+}
+
+var (
+	gatewayEnabled     = flag.Bool("gateway-push-enable", envBool("RUUVI_GATEWAY_PUSH_ENABLE", false), "push Ruuvi Gateway compatible history JSON to a URL")
+	gatewayURL         = flag.String("gateway-push-url", os.Getenv("RUUVI_GATEWAY_PUSH_URL"), "URL to POST Ruuvi Gateway history JSON to")
+	gatewayInterval    = flag.Duration("gateway-push-interval", envDuration("RUUVI_GATEWAY_PUSH_INTERVAL", 10*time.Second), "how often to push to the gateway URL")
+	gatewayUsername    = flag.String("gateway-push-username", os.Getenv("RUUVI_GATEWAY_PUSH_USERNAME"), "HTTP basic auth username for the push URL")
+	gatewayPassword    = flag.String("gateway-push-password", os.Getenv("RUUVI_GATEWAY_PUSH_PASSWORD"), "HTTP basic auth password for the push URL")
+	gatewayBearerToken = flag.String("gateway-push-bearer-token", os.Getenv("RUUVI_GATEWAY_PUSH_BEARER_TOKEN"), "bearer token for the push URL, takes precedence over basic auth")
+	gatewayRate        = flag.Int("gateway-push-rate", envInt("RUUVI_GATEWAY_PUSH_RATE", 0), "value to advertise in the X-Ruuvi-Gateway-Rate header, 0 to omit it")
+	gatewayGzip        = flag.Bool("gateway-push-gzip", envBool("RUUVI_GATEWAY_PUSH_GZIP", false), "gzip-compress the pushed history JSON body")
+	gatewayMaxBackoff  = flag.Duration("gateway-push-max-backoff", envDuration("RUUVI_GATEWAY_PUSH_MAX_BACKOFF", 2*time.Minute), "maximum retry delay after consecutive push failures")
+)
+
+// GatewayConfigFromFlags builds a GatewayConfig from the package's
+// registered flags. Callers must have already called flag.Parse().
+func GatewayConfigFromFlags() GatewayConfig {
+	return GatewayConfig{
+		Enabled:     *gatewayEnabled,
+		URL:         *gatewayURL,
+		Interval:    *gatewayInterval,
+		Username:    *gatewayUsername,
+		Password:    *gatewayPassword,
+		BearerToken: *gatewayBearerToken,
+		Rate:        *gatewayRate,
+		Gzip:        *gatewayGzip,
+		MaxBackoff:  *gatewayMaxBackoff,
+	}
+}
+
+// StartGatewayPusherFromFlags starts a GatewayPusher per the package's
+// registered flags. It does nothing and returns nil unless
+// --gateway-push-enable (or RUUVI_GATEWAY_PUSH_ENABLE) is set. Callers must
+// have already called flag.Parse().
+func StartGatewayPusherFromFlags() *GatewayPusher {
+	cfg := GatewayConfigFromFlags()
+	if !cfg.Enabled {
+		return nil
+	}
+
+	pusher := NewGatewayPusher(cfg)
+	pusher.Start()
+	return pusher
+}
+
+var (
+	gatewayPushTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_gateway_push_total",
+		Help: "Total Ruuvi Gateway push attempts",
+	})
+
+	gatewayPushFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_gateway_push_failed_total",
+		Help: "Total Ruuvi Gateway push attempts that failed",
+	})
+
+	gatewayPushLastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ruuvi_gateway_push_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful Ruuvi Gateway push",
+	})
+)
+
+// GatewayPusher periodically POSTs SnapshotGateway() to a Ruuvi Gateway
+// compatible receiver (Home Assistant, Ruuvi Cloud, ruuvi-station-server,
+// ...), acting as a drop-in replacement for the vendor gateway's push mode.
+type GatewayPusher struct {
+	cfg    GatewayConfig
+	client *http.Client
+
+	inFlight    int32
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+// NewGatewayPusher returns a pusher for cfg. Call Start to begin pushing.
+func NewGatewayPusher(cfg GatewayConfig) *GatewayPusher {
+	return &GatewayPusher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Interval},
+	}
+}
+
+// Start begins pushing SnapshotGateway() to cfg.URL every cfg.Interval in a
+// background goroutine. A push that is still in flight when the next tick
+// fires is skipped rather than overlapped, and a failed push backs off
+// exponentially up to cfg.MaxBackoff before the next attempt is allowed.
+func (p *GatewayPusher) Start() {
+	go func() {
+		for range time.Tick(p.cfg.Interval) {
+			p.tick()
+		}
+	}()
+}
+
+func (p *GatewayPusher) tick() {
+	if !atomic.CompareAndSwapInt32(&p.inFlight, 0, 1) {
+		// Previous push is still running; skip this tick rather than
+		// overlapping two pushes of the same data.
+		return
+	}
+	defer atomic.StoreInt32(&p.inFlight, 0)
+
+	if time.Now().Before(p.nextAttempt) {
+		return
+	}
+
+	if err := p.push(); err != nil {
+		gatewayPushFailedTotal.Inc()
+		log.Printf("gateway push: %v", err)
+
+		if p.backoff == 0 {
+			p.backoff = p.cfg.Interval
+		} else {
+			p.backoff *= 2
+		}
+		if p.backoff > p.cfg.MaxBackoff {
+			p.backoff = p.cfg.MaxBackoff
+		}
+		p.nextAttempt = time.Now().Add(p.backoff)
+	} else {
+		p.backoff = 0
+		p.nextAttempt = time.Time{}
+		gatewayPushLastSuccessTimestamp.SetToCurrentTime()
+	}
+}
+
+func (p *GatewayPusher) push() error {
+	gatewayPushTotal.Inc()
+
+	body, err := json.Marshal(SnapshotGateway())
+	if err != nil {
+		return err
+	}
+
+	var reqBody bytes.Buffer
+	if p.cfg.Gzip {
+		gz := gzip.NewWriter(&reqBody)
+		if _, err := gz.Write(body); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	} else {
+		reqBody.Write(body)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.cfg.URL, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if p.cfg.Rate > 0 {
+		req.Header.Set("X-Ruuvi-Gateway-Rate", strconv.Itoa(p.cfg.Rate))
+	}
+	if p.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.BearerToken)
+	} else if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("gateway push: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -31,6 +31,12 @@ type Tag struct {
 	TxPower						int     `json:"txPower"`
 	MeasurementSequenceNumber	int     `json:"measurementSequenceNumber"`
 	Id							string  `json:"id"`
+	Pm25						float64 `json:"pm25"`
+	Co2							float64 `json:"co2"`
+	Voc							float64 `json:"voc"`
+	Nox							float64 `json:"nox"`
+	Illuminance					float64 `json:"illuminance"`
+	SoundDba					float64 `json:"soundDba"`
 }
 
 
@@ -63,43 +69,64 @@ func init() {
 	macAddress = getMacAddress()
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
-	if r.RequestURI != "/history" {
-		http.NotFound(w, r)
-		return
+// buildTag assembles the /history (and MQTT) JSON representation of a single
+// device from its deviceStore record and the current Prometheus gauge
+// values for that device.
+func buildTag(addr string, rec deviceRecord) Tag {
+	labels := prometheus.Labels{"device": addr}
+	return Tag{
+		Rssi:                      int(readGaugeVec(signalRSSI, labels)),
+		Timestamp:                 rec.lastSeen.Unix(),
+		Data:                      rec.rawHex,
+		DataFormat:                rec.format,
+		Temperature:               readGaugeVec(temperature, labels),
+		Humidity:                  readGaugeVec(humidity, labels),
+		Pressure:                  int(readGaugeVec(pressure, labels)),
+		AccelX:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "X"}),
+		AccelY:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "Y"}),
+		AccelZ:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "Z"}),
+		MovementCounter:           int(readGaugeVec(moveCount, labels)),
+		Voltage:                   readGaugeVec(voltage, labels),
+		TxPower:                   int(readGaugeVec(txPower, labels)),
+		MeasurementSequenceNumber: int(readGaugeVec(seqno, labels)),
+		Id:                        strings.ToUpper(addr),
+		Pm25:                      readGaugeVec(pm25, labels),
+		Co2:                       readGaugeVec(co2, labels),
+		Voc:                       readGaugeVec(voc, labels),
+		Nox:                       readGaugeVec(nox, labels),
+		Illuminance:               readGaugeVec(illuminance, labels),
+		SoundDba:                  readGaugeVec(soundDBA, labels),
 	}
+}
 
+// SnapshotGateway builds the Ruuvi Gateway compatible HistoryData document
+// for every currently known device. It is the single source of truth for
+// that shape: the /history pull endpoint and the push client (gateway.go)
+// both call it so they can never drift apart.
+func SnapshotGateway() HistoryData {
 	data := HistoryData{
 		Data: Gateway{
 			Coordinates: "",
-			Timestamp: time.Now().Unix(),
-			GwMac: macAddress,
-			Tags: make(map[string]Tag),
+			Timestamp:   time.Now().Unix(),
+			GwMac:       macAddress,
+			Tags:        make(map[string]Tag),
 		},
 	}
 
-	for addr, ls := range deviceLastSeen {
-		labels := prometheus.Labels{"device": addr}
-		data.Data.Tags[strings.ToUpper(addr)] = Tag{
-			Rssi:                      int(readGaugeVec(signalRSSI, labels)),
-			Timestamp:                 ls.Unix(),
-			Data:                      deviceRawData[addr],
-			DataFormat:                deviceRawDataFormat[addr],
-			Temperature:               readGaugeVec(temperature, labels),
-			Humidity:                  readGaugeVec(humidity, labels),
-			Pressure:                  int(readGaugeVec(pressure, labels)),
-			AccelX:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "X"}),
-			AccelY:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "Y"}),
-			AccelZ:                    readGaugeVec(acceleration, prometheus.Labels{"device": addr, "axis": "Z"}),
-			MovementCounter:           int(readGaugeVec(moveCount, labels)),
-			Voltage:                   readGaugeVec(voltage, labels),
-			TxPower:                   int(readGaugeVec(txPower, labels)),
-			MeasurementSequenceNumber: int(readGaugeVec(seqno, labels)),
-			Id: strings.ToUpper(addr),
-		}
+	store.Range(func(addr string, rec deviceRecord) {
+		data.Data.Tags[strings.ToUpper(addr)] = buildTag(addr, rec)
+	})
+
+	return data
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.RequestURI != "/history" {
+		http.NotFound(w, r)
+		return
 	}
 
-	body, err := json.MarshalIndent(data, "", "    ")
+	body, err := json.MarshalIndent(SnapshotGateway(), "", "    ")
 
 	if err != nil {
 		w.Header().Set("Content-Type", "text/plain")
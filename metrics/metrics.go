@@ -27,15 +27,16 @@ package metrics
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"flag"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	dto "github.com/prometheus/client_model/go"
 	"gitlab.com/jtaimisto/bluewalker/host"
-	"gitlab.com/jtaimisto/bluewalker/ruuvi"
+
+	"github.com/annttu/ruuvi-prometheus/decode"
 )
 
 var (
@@ -93,29 +94,61 @@ var (
 		Name: "ruuvi_seqno_current",
 		Help: "Ruuvi frame sequence number",
 	}, []string{"device"})
+
+	pm25 = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_pm25_ugm3",
+		Help: "Ruuvi Air PM2.5 concentration",
+	}, []string{"device"})
+
+	co2 = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_co2_ppm",
+		Help: "Ruuvi Air CO2 concentration",
+	}, []string{"device"})
+
+	voc = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_voc_index",
+		Help: "Ruuvi Air volatile organic compound index",
+	}, []string{"device"})
+
+	nox = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_nox_index",
+		Help: "Ruuvi Air nitrogen oxide index",
+	}, []string{"device"})
+
+	illuminance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_illuminance_lux",
+		Help: "Ruuvi Air ambient light level",
+	}, []string{"device"})
+
+	soundDBA = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_sound_dba",
+		Help: "Ruuvi Air ambient sound level",
+	}, []string{"device"})
 )
 
 // ttl is the duration after which sensors are forgotten if signal is lost.
 const ttl = 1 * time.Minute
 
-var deviceLastSeen map[string]time.Time
-var deviceRawData map[string]string
-var deviceRawDataFormat map[string]int
+var deviceStoreSize = flag.Int("device-store-size", envInt("RUUVI_DEVICE_STORE_SIZE", 10000),
+	"maximum number of devices to remember at once, oldest evicted first; 0 for unbounded")
 
-var mu sync.Mutex
+var store *deviceStore
 
 func init() {
-	deviceLastSeen = make(map[string]time.Time)
-	deviceRawData = make(map[string]string)
-	deviceRawDataFormat = make(map[string]int)
+	store = newDeviceStore(*deviceStoreSize, deleteDeviceMetrics)
+
+	RegisterSink(prometheusSink{})
 
 	go func() {
 		for range time.Tick(time.Minute) {
-			clearExpired()
+			store.Expire(ttl)
 		}
 	}()
 }
 
+// ObserveRuuvi records a decoded reading and fans it out to every registered
+// Sink (see sink.go), so each sink works from the same decoded reading
+// instead of re-parsing the advertisement.
 func ObserveRuuvi(o RuuviReading, rawData []byte) {
 	addr := o.Address.String()
 
@@ -123,33 +156,105 @@ func ObserveRuuvi(o RuuviReading, rawData []byte) {
 		rawData = rawData[2:]
 	}
 
-	mu.Lock()
-	deviceLastSeen[addr] = time.Now()
+	raw, dataFormat := decodeRawHex(rawData)
+
+	store.Touch(addr, deviceRecord{
+		lastSeen: time.Now(),
+		rawHex:   raw,
+		format:   dataFormat,
+		reading:  o,
+	})
+
+	for _, s := range sinks() {
+		s.Observe(addr, o, rawData)
+	}
+}
 
-	// FIXME: Add more robust parsing for version string
+// decodeRawHex reconstructs the raw advertisement hex string and Ruuvi data
+// format byte from the manufacturer-specific data, the same way the
+// /history endpoint and MQTT payloads represent a reading.
+//
+// FIXME: Add more robust parsing for version string
+func decodeRawHex(rawData []byte) (raw string, dataFormat int) {
 	if len(rawData) > 1 {
-		deviceRawData[addr] = strings.ToUpper("0201061BFF9904" + hex.EncodeToString(rawData))
-		deviceRawDataFormat[addr] = int(rawData[0])
-	} else {
-		deviceRawData[addr] = ""
-		deviceRawDataFormat[addr] = 5
+		return strings.ToUpper("0201061BFF9904" + hex.EncodeToString(rawData)), int(rawData[0])
+	}
+	return "", 5
+}
+
+var enableHistograms = flag.Bool("enable-histograms", envBool("RUUVI_ENABLE_HISTOGRAMS", false),
+	"expose per-device HistogramVec observations for temperature/humidity/pressure/voltage, so quantiles can be computed across the scrape interval")
+
+var (
+	temperatureHistogram *prometheus.HistogramVec
+	humidityHistogram    *prometheus.HistogramVec
+	pressureHistogram    *prometheus.HistogramVec
+	voltageHistogram     *prometheus.HistogramVec
+)
+
+func init() {
+	if !*enableHistograms {
+		return
 	}
 
-	mu.Unlock()
+	temperatureHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ruuvi_temperature_celsius_histogram",
+		Help:    "Ruuvi tag sensor temperature",
+		Buckets: []float64{-10, -5, 0, 5, 10, 15, 18, 20, 22, 24, 26, 28, 30, 35, 40},
+	}, []string{"device"})
+
+	humidityHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ruuvi_humidity_ratio_histogram",
+		Help:    "Ruuvi tag sensor relative humidity",
+		Buckets: []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+	}, []string{"device"})
+
+	pressureHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ruuvi_pressure_hpa_histogram",
+		Help:    "Ruuvi tag sensor air pressure",
+		Buckets: []float64{950, 970, 990, 1000, 1010, 1013, 1020, 1030, 1050},
+	}, []string{"device"})
+
+	voltageHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ruuvi_battery_volts_histogram",
+		Help:    "Ruuvi tag battery voltage",
+		Buckets: []float64{2.0, 2.2, 2.4, 2.5, 2.6, 2.7, 2.8, 2.9, 3.0, 3.2, 3.6},
+	}, []string{"device"})
+}
+
+// prometheusSink is the built-in Sink that records readings as Prometheus
+// metrics. It is always registered; see the first init() above.
+type prometheusSink struct{}
 
+func (prometheusSink) Observe(addr string, o RuuviReading, rawData []byte) {
 	ruuviFrames.WithLabelValues(addr).Inc()
 	signalRSSI.WithLabelValues(addr).Set(float64(o.Rssi))
 	if o.VoltageValid() {
-		voltage.WithLabelValues(addr).Set(float64(o.Voltage) / 1000)
+		volts := float64(o.Voltage) / 1000
+		voltage.WithLabelValues(addr).Set(volts)
+		if voltageHistogram != nil {
+			voltageHistogram.WithLabelValues(addr).Observe(volts)
+		}
 	}
 	if o.PressureValid() {
-		pressure.WithLabelValues(addr).Set(float64(o.Pressure) / 100)
+		hpa := float64(o.Pressure) / 100
+		pressure.WithLabelValues(addr).Set(hpa)
+		if pressureHistogram != nil {
+			pressureHistogram.WithLabelValues(addr).Observe(hpa)
+		}
 	}
 	if o.TemperatureValid() {
 		temperature.WithLabelValues(addr).Set(float64(o.Temperature))
+		if temperatureHistogram != nil {
+			temperatureHistogram.WithLabelValues(addr).Observe(float64(o.Temperature))
+		}
 	}
 	if o.HumidityValid() {
-		humidity.WithLabelValues(addr).Set(float64(o.Humidity) / 100)
+		pct := float64(o.Humidity) / 100
+		humidity.WithLabelValues(addr).Set(pct)
+		if humidityHistogram != nil {
+			humidityHistogram.WithLabelValues(addr).Observe(pct)
+		}
 	}
 	if o.AccelerationValid() {
 		acceleration.WithLabelValues(addr, "X").Set(float64(o.AccelerationX))
@@ -166,51 +271,67 @@ func ObserveRuuvi(o RuuviReading, rawData []byte) {
 	if o.SeqnoValid() {
 		seqno.WithLabelValues(addr).Set(float64(o.Seqno))
 	}
+	if o.PM25Valid() {
+		pm25.WithLabelValues(addr).Set(o.PM25)
+	}
+	if o.CO2Valid() {
+		co2.WithLabelValues(addr).Set(o.CO2)
+	}
+	if o.VOCValid() {
+		voc.WithLabelValues(addr).Set(o.VOC)
+	}
+	if o.NOxValid() {
+		nox.WithLabelValues(addr).Set(o.NOx)
+	}
+	if o.IlluminanceValid() {
+		illuminance.WithLabelValues(addr).Set(o.Illuminance)
+	}
+	if o.SoundDBAValid() {
+		soundDBA.WithLabelValues(addr).Set(o.SoundDBA)
+	}
 }
 
-func clearExpired() {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// log.Println("Checking for expired devices")
-	now := time.Now()
-	for addr, ls := range deviceLastSeen {
-		if now.Sub(ls) > ttl {
-			// log.Printf("%v expired", addr)
-			ruuviFrames.DeleteLabelValues(addr)
-			signalRSSI.DeleteLabelValues(addr)
-			voltage.DeleteLabelValues(addr)
-			pressure.DeleteLabelValues(addr)
-			temperature.DeleteLabelValues(addr)
-			humidity.DeleteLabelValues(addr)
-			acceleration.DeleteLabelValues(addr, "X")
-			acceleration.DeleteLabelValues(addr, "Y")
-			acceleration.DeleteLabelValues(addr, "Z")
-			format.DeleteLabelValues(addr)
-			txPower.DeleteLabelValues(addr)
-			moveCount.DeleteLabelValues(addr)
-			seqno.DeleteLabelValues(addr)
-
-			delete(deviceLastSeen, addr)
-			delete(deviceRawData, addr)
-		}
+// deleteDeviceMetrics removes every Prometheus series for addr. It is the
+// deviceStore's onEvict callback, so a device is always removed from the
+// store and its metrics deleted as a single atomic step.
+func deleteDeviceMetrics(addr string) {
+	ruuviFrames.DeleteLabelValues(addr)
+	signalRSSI.DeleteLabelValues(addr)
+	voltage.DeleteLabelValues(addr)
+	pressure.DeleteLabelValues(addr)
+	temperature.DeleteLabelValues(addr)
+	humidity.DeleteLabelValues(addr)
+	acceleration.DeleteLabelValues(addr, "X")
+	acceleration.DeleteLabelValues(addr, "Y")
+	acceleration.DeleteLabelValues(addr, "Z")
+	format.DeleteLabelValues(addr)
+	txPower.DeleteLabelValues(addr)
+	moveCount.DeleteLabelValues(addr)
+	seqno.DeleteLabelValues(addr)
+	pm25.DeleteLabelValues(addr)
+	co2.DeleteLabelValues(addr)
+	voc.DeleteLabelValues(addr)
+	nox.DeleteLabelValues(addr)
+	illuminance.DeleteLabelValues(addr)
+	soundDBA.DeleteLabelValues(addr)
+
+	if temperatureHistogram != nil {
+		temperatureHistogram.DeleteLabelValues(addr)
+		humidityHistogram.DeleteLabelValues(addr)
+		pressureHistogram.DeleteLabelValues(addr)
+		voltageHistogram.DeleteLabelValues(addr)
 	}
 }
 
 type RuuviReading struct {
 	*host.ScanReport
-	*ruuvi.Data
+	*decode.Reading
 }
 
-// DataFormat guesses the Ruuvi protocol data format version. In case of
-// protocol version 3, tx power, movement counter and sequence number are
-// not valid. Otherwise guess version is 5.
+// DataFormat returns the Ruuvi protocol data format version the reading
+// was decoded as (3, 5, 6, 8, or the E0/F0 diagnostic formats).
 func (r RuuviReading) DataFormat() int {
-	if !r.TxPowerValid() && !r.MoveCountValid() && !r.SeqnoValid() {
-		return 3
-	} else {
-		return 5
-	}
+	return r.Format
 }
 
 
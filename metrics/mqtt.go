@@ -0,0 +1,287 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MQTTConfig configures the MQTT sink. Flag defaults fall back to the
+// matching RUUVI_MQTT_* environment variable so the exporter can be
+// configured purely through the environment in container deployments.
+type MQTTConfig struct {
+	Enabled  bool
+	Broker   string
+	Port     int
+	TLS      bool
+	Username string
+	Password string
+	ClientID string
+	QoS      int
+	Retained bool
+	Topic    string
+
+	// QueueSize bounds how many readings are buffered while the client is
+	// disconnected; the oldest queued reading is dropped to make room.
+	QueueSize int
+}
+
+var (
+	mqttEnabled   = flag.Bool("mqtt-enable", envBool("RUUVI_MQTT_ENABLE", false), "publish readings to an MQTT broker")
+	mqttBroker    = flag.String("mqtt-broker", os.Getenv("RUUVI_MQTT_BROKER"), "MQTT broker hostname")
+	mqttPort      = flag.Int("mqtt-port", envInt("RUUVI_MQTT_PORT", 1883), "MQTT broker port")
+	mqttTLS       = flag.Bool("mqtt-tls", envBool("RUUVI_MQTT_TLS", false), "use TLS when connecting to the MQTT broker")
+	mqttUsername  = flag.String("mqtt-username", os.Getenv("RUUVI_MQTT_USERNAME"), "MQTT username")
+	mqttPassword  = flag.String("mqtt-password", os.Getenv("RUUVI_MQTT_PASSWORD"), "MQTT password")
+	mqttClientID  = flag.String("mqtt-client-id", envOr("RUUVI_MQTT_CLIENT_ID", "ruuvi-prometheus"), "MQTT client identifier")
+	mqttQoS       = flag.Int("mqtt-qos", envInt("RUUVI_MQTT_QOS", 0), "MQTT publish QoS (0, 1 or 2)")
+	mqttRetained  = flag.Bool("mqtt-retain", envBool("RUUVI_MQTT_RETAIN", false), "publish MQTT messages with the retained flag set")
+	mqttTopic     = flag.String("mqtt-topic", envOr("RUUVI_MQTT_TOPIC", "ruuvi/{device}/state"), "MQTT topic, with {device} and {format} replaced per reading")
+	mqttQueueSize = flag.Int("mqtt-queue-size", envInt("RUUVI_MQTT_QUEUE_SIZE", 1000), "number of readings buffered while disconnected from the broker")
+)
+
+// MQTTConfigFromFlags builds an MQTTConfig from the package's registered
+// flags. Callers must have already called flag.Parse().
+func MQTTConfigFromFlags() MQTTConfig {
+	return MQTTConfig{
+		Enabled:   *mqttEnabled,
+		Broker:    *mqttBroker,
+		Port:      *mqttPort,
+		TLS:       *mqttTLS,
+		Username:  *mqttUsername,
+		Password:  *mqttPassword,
+		ClientID:  *mqttClientID,
+		QoS:       *mqttQoS,
+		Retained:  *mqttRetained,
+		Topic:     *mqttTopic,
+		QueueSize: *mqttQueueSize,
+	}
+}
+
+// StartMQTTSinkFromFlags connects an MQTTSink per the package's registered
+// flags and registers it to receive every future reading. It does nothing
+// and returns (nil, nil) unless --mqtt-enable (or RUUVI_MQTT_ENABLE) is set.
+// Callers must have already called flag.Parse().
+func StartMQTTSinkFromFlags() (*MQTTSink, error) {
+	cfg := MQTTConfigFromFlags()
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	sink, err := NewMQTTSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	RegisterSink(sink)
+	return sink, nil
+}
+
+var (
+	mqttPublishTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_mqtt_publish_total",
+		Help: "Total MQTT publish attempts",
+	})
+
+	mqttPublishFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_mqtt_publish_failed_total",
+		Help: "Total MQTT publish attempts that failed",
+	})
+
+	mqttPublishDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_mqtt_publish_dropped_total",
+		Help: "Total readings dropped because the MQTT publish queue was full",
+	})
+)
+
+// MQTTSink publishes every observed reading to an MQTT broker as per-tag
+// JSON, using the same fields the /history endpoint exposes. It satisfies
+// Sink.
+type MQTTSink struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+	retain bool
+	queue  chan mqttMessage
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// NewMQTTSink connects to the broker described by cfg and returns a Sink
+// that publishes readings to it. The underlying paho client reconnects
+// automatically on connection loss; while disconnected, outgoing messages
+// are queued up to cfg.QueueSize, dropping the oldest once full.
+func NewMQTTSink(cfg MQTTConfig) (*MQTTSink, error) {
+	scheme := "tcp"
+	if cfg.TLS {
+		scheme = "ssl"
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(scheme + "://" + cfg.Broker + ":" + strconv.Itoa(cfg.Port))
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOrderMatters(false)
+	if cfg.TLS {
+		opts.SetTLSConfig(&tls.Config{})
+	}
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("mqtt: connection lost: %v", err)
+	})
+	opts.SetOnConnectHandler(func(_ mqtt.Client) {
+		log.Printf("mqtt: connected to %s:%d", cfg.Broker, cfg.Port)
+	})
+
+	s := &MQTTSink{
+		client: mqtt.NewClient(opts),
+		topic:  cfg.Topic,
+		qos:    byte(cfg.QoS),
+		retain: cfg.Retained,
+		queue:  make(chan mqttMessage, cfg.QueueSize),
+	}
+
+	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	go s.drainQueue()
+
+	return s, nil
+}
+
+// Observe implements Sink by rendering the reading as Tag JSON and queueing
+// it for publish on the device's topic.
+func (s *MQTTSink) Observe(addr string, o RuuviReading, rawData []byte) {
+	rec, ok := store.Get(addr)
+	if !ok {
+		// ObserveRuuvi always touches the store before dispatching to
+		// sinks, so this only happens if the device was evicted in the
+		// instant between the two; skip rather than publish stale data.
+		return
+	}
+	tag := buildTag(addr, rec)
+
+	payload, err := json.Marshal(tag)
+	if err != nil {
+		log.Printf("mqtt: marshal reading for %s: %v", addr, err)
+		return
+	}
+
+	topic := strings.NewReplacer(
+		"{device}", addr,
+		"{format}", strconv.Itoa(rec.format),
+	).Replace(s.topic)
+
+	msg := mqttMessage{topic: topic, payload: payload}
+	select {
+	case s.queue <- msg:
+	default:
+		// Queue full: drop the oldest queued message to make room for
+		// the latest reading.
+		select {
+		case <-s.queue:
+			mqttPublishDroppedTotal.Inc()
+		default:
+		}
+		select {
+		case s.queue <- msg:
+		default:
+		}
+	}
+}
+
+// drainQueue publishes queued messages in order, blocking on each publish
+// until it is accepted by the client so offline readings buffer rather than
+// being published out of order.
+func (s *MQTTSink) drainQueue() {
+	for msg := range s.queue {
+		mqttPublishTotal.Inc()
+		token := s.client.Publish(msg.topic, s.qos, s.retain, msg.payload)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			mqttPublishFailedTotal.Inc()
+			log.Printf("mqtt: publish to %s: %v", msg.topic, err)
+		}
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+func envInt(key string, fallback int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return i
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import "sync"
+
+// Sink receives every decoded Ruuvi reading as it is observed. Registering a
+// Sink lets a new output (Prometheus metrics, MQTT, ...) consume the already
+// decoded reading without re-parsing the advertisement bytes.
+type Sink interface {
+	// Observe is called once per decoded advertisement. addr is the
+	// lowercase device MAC, o the decoded reading and rawData the
+	// manufacturer-specific bytes the reading was parsed from.
+	Observe(addr string, o RuuviReading, rawData []byte)
+}
+
+var (
+	sinksMu    sync.Mutex
+	registered []Sink
+)
+
+// RegisterSink adds a Sink that will receive every future reading observed
+// via ObserveRuuvi. It is safe to call from package init functions.
+func RegisterSink(s Sink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	registered = append(registered, s)
+}
+
+// sinks returns a snapshot of the currently registered sinks.
+func sinks() []Sink {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	out := make([]Sink, len(registered))
+	copy(out, registered)
+	return out
+}
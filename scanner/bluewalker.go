@@ -0,0 +1,108 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package scanner
+
+import (
+	"fmt"
+
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/host"
+	"gitlab.com/jtaimisto/bluewalker/ruuvi"
+
+	"github.com/annttu/ruuvi-prometheus/decode"
+	"github.com/annttu/ruuvi-prometheus/metrics"
+)
+
+// BluewalkerScanner is the original Scanner backend: a raw Linux HCI
+// socket driven by gitlab.com/jtaimisto/bluewalker. It requires root or
+// the cap_net_raw/cap_net_admin capabilities on the process.
+type BluewalkerScanner struct {
+	device string
+	keys   *decode.KeyStore
+	raw    *host.RawHciSocket
+	dev    *host.HostScanner
+	out    chan Reading
+}
+
+// NewBluewalkerScanner returns a Scanner that reads advertisements from the
+// named HCI device, e.g. "hci0". keys decrypts format 8 frames and may be
+// nil if none are expected.
+func NewBluewalkerScanner(device string, keys *decode.KeyStore) *BluewalkerScanner {
+	return &BluewalkerScanner{device: device, keys: keys}
+}
+
+// Start implements Scanner.
+func (s *BluewalkerScanner) Start() (<-chan Reading, error) {
+	raw, err := host.NewRawHciSocket(s.device)
+	if err != nil {
+		return nil, fmt.Errorf("bluewalker: open %s: %w", s.device, err)
+	}
+
+	dev := host.NewHostScanner(raw)
+	if err := dev.Init(); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("bluewalker: init: %w", err)
+	}
+
+	reports, err := dev.StartScanning(false, filter.NewManufucturerFilter(ruuvi.BeaconID))
+	if err != nil {
+		dev.Deinit()
+		raw.Close()
+		return nil, fmt.Errorf("bluewalker: start scanning: %w", err)
+	}
+
+	s.raw = raw
+	s.dev = dev
+	s.out = make(chan Reading)
+
+	go func() {
+		defer close(s.out)
+		for report := range reports {
+			rawData := report.Data.Bytes()
+			data, err := decode.Decode(report.Address.String(), rawData, s.keys)
+			if err != nil {
+				continue
+			}
+			s.out <- Reading{
+				Data: metrics.RuuviReading{ScanReport: report, Reading: data},
+				Raw:  rawData,
+			}
+		}
+	}()
+
+	return s.out, nil
+}
+
+// Stop implements Scanner.
+func (s *BluewalkerScanner) Stop() error {
+	if s.dev != nil {
+		s.dev.StopScanning()
+		s.dev.Deinit()
+	}
+	if s.raw != nil {
+		return s.raw.Close()
+	}
+	return nil
+}
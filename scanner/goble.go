@@ -0,0 +1,105 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/examples/lib/dev"
+	"gitlab.com/jtaimisto/bluewalker/host"
+
+	"github.com/annttu/ruuvi-prometheus/decode"
+	"github.com/annttu/ruuvi-prometheus/metrics"
+)
+
+// GoBLEScanner is the go-ble/ble backed Scanner. Unlike BluewalkerScanner
+// it does not need a raw HCI socket, so it also runs on macOS and Windows
+// and is useful as a development fallback when bluewalker's HCI code
+// breaks on a given kernel.
+type GoBLEScanner struct {
+	device string
+	keys   *decode.KeyStore
+	cancel context.CancelFunc
+	out    chan Reading
+}
+
+// NewGoBLEScanner returns a Scanner that reads advertisements through
+// go-ble/ble using the named device (e.g. "default" or a platform device
+// index). keys decrypts format 8 frames and may be nil if none are
+// expected.
+func NewGoBLEScanner(device string, keys *decode.KeyStore) *GoBLEScanner {
+	return &GoBLEScanner{device: device, keys: keys}
+}
+
+// Start implements Scanner.
+func (s *GoBLEScanner) Start() (<-chan Reading, error) {
+	d, err := dev.NewDevice(s.device)
+	if err != nil {
+		return nil, fmt.Errorf("goble: open device %s: %w", s.device, err)
+	}
+	ble.SetDefaultDevice(d)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.out = make(chan Reading)
+
+	go func() {
+		defer close(s.out)
+		err := ble.Scan(ctx, true, func(a ble.Advertisement) {
+			rawData := a.ManufacturerData()
+			addr := a.Addr().String()
+			data, err := decode.Decode(addr, rawData, s.keys)
+			if err != nil {
+				return
+			}
+			s.out <- Reading{
+				Data: metrics.RuuviReading{
+					ScanReport: &host.ScanReport{
+						Address: host.BtAddress{Address: a.Addr().Bytes()},
+						Rssi:    a.RSSI(),
+					},
+					Reading: data,
+				},
+				Raw: rawData,
+			}
+		}, nil)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("goble: scan ended: %v", err)
+		}
+	}()
+
+	return s.out, nil
+}
+
+// Stop implements Scanner.
+func (s *GoBLEScanner) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package scanner
+
+// MockScanner is a Scanner backed by an in-memory channel instead of a
+// real BLE adapter. Tests use it to inject synthetic advertisements
+// without a Bluetooth adapter present.
+type MockScanner struct {
+	out    chan Reading
+	closed bool
+}
+
+// NewMockScanner returns a ready-to-use MockScanner.
+func NewMockScanner() *MockScanner {
+	return &MockScanner{out: make(chan Reading)}
+}
+
+// Start implements Scanner.
+func (s *MockScanner) Start() (<-chan Reading, error) {
+	return s.out, nil
+}
+
+// Stop implements Scanner.
+func (s *MockScanner) Stop() error {
+	if !s.closed {
+		s.closed = true
+		close(s.out)
+	}
+	return nil
+}
+
+// Inject delivers r to the scanner's output channel as if it had been
+// received over the air. It blocks until a consumer reads it.
+func (s *MockScanner) Inject(r Reading) {
+	s.out <- r
+}
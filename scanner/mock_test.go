@@ -0,0 +1,69 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package scanner
+
+import "testing"
+
+func TestMockScannerInject(t *testing.T) {
+	s := NewMockScanner()
+
+	out, err := s.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	want := Reading{Raw: []byte{0x01, 0x02, 0x03}}
+	go s.Inject(want)
+
+	got, ok := <-out
+	if !ok {
+		t.Fatal("out channel closed before delivering the injected reading")
+	}
+	if string(got.Raw) != string(want.Raw) {
+		t.Errorf("Raw = %v, want %v", got.Raw, want.Raw)
+	}
+}
+
+func TestMockScannerStopClosesChannel(t *testing.T) {
+	s := NewMockScanner()
+
+	out, err := s.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop (second call): %v", err)
+	}
+
+	if _, ok := <-out; ok {
+		t.Error("out channel still open after Stop")
+	}
+}
+
+var _ Scanner = (*MockScanner)(nil)
@@ -0,0 +1,108 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package scanner abstracts over the BLE stack used to discover Ruuvi tags,
+// so the rest of the exporter does not care whether advertisements come
+// from a raw HCI socket, a cross-platform BLE library or a test fixture.
+package scanner
+
+import (
+	"flag"
+
+	"github.com/annttu/ruuvi-prometheus/decode"
+	"github.com/annttu/ruuvi-prometheus/metrics"
+)
+
+// Reading is a single decoded Ruuvi advertisement together with the raw
+// manufacturer-specific bytes it was parsed from, exactly what
+// metrics.ObserveRuuvi expects.
+type Reading struct {
+	Data metrics.RuuviReading
+	Raw  []byte
+}
+
+// Scanner discovers BLE advertisements and decodes the Ruuvi ones into
+// Readings. Implementations must be safe to Stop from a different
+// goroutine than the one that called Start.
+type Scanner interface {
+	// Start begins scanning and returns a channel of Readings. The
+	// channel is closed when the scanner stops, whether via Stop or a
+	// fatal error.
+	Start() (<-chan Reading, error)
+
+	// Stop ends scanning and releases the underlying adapter.
+	Stop() error
+}
+
+// Backend names a Scanner implementation selectable via --ble-backend.
+type Backend string
+
+const (
+	// BackendBluewalker uses gitlab.com/jtaimisto/bluewalker over a raw
+	// Linux HCI socket. It is the default and requires root or the
+	// cap_net_raw / cap_net_admin capabilities.
+	BackendBluewalker Backend = "bluewalker"
+
+	// BackendGoBLE uses github.com/go-ble/ble, which works on macOS and
+	// Windows in addition to Linux and doesn't require raw HCI access.
+	BackendGoBLE Backend = "goble"
+)
+
+var bleBackend = flag.String("ble-backend", string(BackendBluewalker),
+	"BLE scanner backend to use: bluewalker or goble")
+
+// New returns the Scanner for the given backend, using device as the BLE
+// adapter identifier (e.g. "hci0" for bluewalker or a go-ble device index).
+// keys decrypts format 8 frames and may be nil if none are expected.
+func New(backend Backend, device string, keys *decode.KeyStore) (Scanner, error) {
+	switch backend {
+	case BackendBluewalker, "":
+		return NewBluewalkerScanner(device, keys), nil
+	case BackendGoBLE:
+		return NewGoBLEScanner(device, keys), nil
+	default:
+		return nil, &UnknownBackendError{Backend: backend}
+	}
+}
+
+// NewFromFlags returns the Scanner selected by --ble-backend, with its
+// format-8 key store loaded per --ruuvi-key-file. Callers must have
+// already called flag.Parse().
+func NewFromFlags(device string) (Scanner, error) {
+	keys, err := decode.KeyStoreFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	return New(Backend(*bleBackend), device, keys)
+}
+
+// UnknownBackendError is returned by New when asked for a Backend it
+// doesn't recognize.
+type UnknownBackendError struct {
+	Backend Backend
+}
+
+func (e *UnknownBackendError) Error() string {
+	return "scanner: unknown BLE backend " + string(e.Backend)
+}